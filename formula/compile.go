@@ -0,0 +1,347 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+)
+
+// Opcode 是 RPN 字节码指令的操作类型。AST 被编译为一串扁平的后缀指令流，
+// 由 Program.Run 在一个 []float64 值栈上执行，省去了回测时对同一棵树反复
+// 递归求值的开销。
+type Opcode string
+
+const (
+	OP_PUSH_CONST  Opcode = "PUSH_CONST"  // 压入一个常量，已展开为整条时间序列
+	OP_PUSH_VAR    Opcode = "PUSH_VAR"    // 压入 CLOSE/OPEN/HIGH/LOW 等行情变量
+	OP_PUSH_SYMBOL Opcode = "PUSH_SYMBOL" // 压入此前 STORE 过的符号
+	OP_CALL        Opcode = "CALL"        // 调用内置函数，Arg 为参数个数
+	OP_BINOP       Opcode = "BINOP"       // 算术运算 + - * /
+	OP_CMP         Opcode = "CMP"         // 比较/逻辑运算 < <= > >= = == != AND OR
+	OP_NOT         Opcode = "NOT"         // 一元逻辑非
+	OP_STORE       Opcode = "STORE"       // 弹出栈顶，写入符号表
+)
+
+// Instruction 是一条字节码指令；Operand 是操作数（常量值/变量名/函数名/运算符），
+// Arg 是辅助的整型操作数（目前只有 CALL 用它表示参数个数）。
+type Instruction struct {
+	Op      Opcode
+	Operand string
+	Arg     int
+}
+
+// Program 是编译后的指令流，可以在不同的 data 数据集上反复执行。registry 是
+// 编译期绑定的 FunctionRegistry，Run 通过它分派 OP_CALL，使编译后的程序和
+// ParseApp 使用同一套内置/自定义指标实现。
+type Program struct {
+	instructions []Instruction
+	registry     *FunctionRegistry
+}
+
+var (
+	programCacheMu sync.Mutex
+	programCache   = map[string]*Program{}
+
+	defaultCompileRegistryOnce sync.Once
+	defaultCompileRegistry     *FunctionRegistry
+)
+
+// sharedDefaultRegistry returns one DefaultRegistry shared by every
+// Compile(src, nil) call. Without this, each call would allocate its own
+// DefaultRegistry and the program cache (keyed in part by registry
+// identity) would miss every time instead of deduping repeated compiles of
+// the same source.
+func sharedDefaultRegistry() *FunctionRegistry {
+	defaultCompileRegistryOnce.Do(func() {
+		defaultCompileRegistry = DefaultRegistry()
+	})
+	return defaultCompileRegistry
+}
+
+// Compile 把公式脚本编译为 RPN 字节码程序。相同的源码、相同的 registry 只会
+// 被词法分析、语法分析和编译一次，后续调用直接命中缓存，适合用同一份指标
+// 脚本回测成千上万只股票的场景。registry 为 nil 时退回 DefaultRegistry，和
+// NewParser 的约定一致；传入自定义 FunctionRegistry 后，Program.Run 里的
+// OP_CALL 会通过它分派，使编译后的程序支持和 ParseApp 一样的自定义指标。
+func Compile(src string, registry *FunctionRegistry) (*Program, error) {
+	if registry == nil {
+		registry = sharedDefaultRegistry()
+	}
+	cacheKey := fmt.Sprintf("%p:%s", registry, src)
+
+	programCacheMu.Lock()
+	if prog, ok := programCache[cacheKey]; ok {
+		programCacheMu.Unlock()
+		return prog, nil
+	}
+	programCacheMu.Unlock()
+
+	lexer := NewLexer(src)
+	tokens, err := lexer.Tokenize()
+	if err != nil {
+		return nil, err
+	}
+	// Compile 只需要语法树，不依赖具体的行情数据，真正的数值在 Run 时才绑定。
+	parser := NewParser(tokens, nil, registry, src)
+	var instructions []Instruction
+	for {
+		_, err := parser.nextToken()
+		if err != nil {
+			break // 没有更多 token 了，脚本编译完毕
+		}
+		parser.cursor--
+		ident, expr, err := parser.parseCompilableStatement()
+		if err != nil {
+			return nil, err
+		}
+		instructions, err = compileNode(instructions, expr)
+		if err != nil {
+			return nil, err
+		}
+		if ident != "" {
+			instructions = append(instructions, Instruction{Op: OP_STORE, Operand: ident})
+			// 标记该符号已声明，使后续语句里的 parseFactor 能把它解析成
+			// SYMBOL_NODE；真正的数值要等 Run 时才产生。
+			parser.symbolTable[ident] = []float64{}
+		}
+		semi, err := parser.nextToken()
+		if err != nil || semi.Type != SEMICOLON {
+			return nil, fmt.Errorf("expected ';'")
+		}
+	}
+
+	prog := &Program{instructions: instructions, registry: registry}
+	programCacheMu.Lock()
+	programCache[cacheKey] = prog
+	programCacheMu.Unlock()
+	return prog, nil
+}
+
+// parseCompilableStatement 解析一条语句并返回它赋值的符号名（表达式语句为空
+// 字符串）及其 AST，供 compileNode 降级为字节码，而不落盘求值结果。
+func (p *Parser) parseCompilableStatement() (string, *Node, error) {
+	token, err := p.nextToken()
+	if err != nil {
+		return "", nil, err
+	}
+	if token.Type == IDENTIFIER {
+		next, err := p.nextToken()
+		if err != nil {
+			return "", nil, err
+		}
+		if next.Type == ASSIGN_OP {
+			ident := token.Value
+			if p.registry.IsConstant(ident) || p.registry.IsFunction(ident) {
+				return "", nil, fmt.Errorf("'%s' is a reserved word", ident)
+			}
+			expr, err := p.parseLogicOr()
+			if err != nil {
+				return "", nil, err
+			}
+			return ident, expr, nil
+		}
+		p.cursor -= 2
+		expr, err := p.parseLogicOr()
+		return "", expr, err
+	}
+	p.cursor--
+	expr, err := p.parseLogicOr()
+	return "", expr, err
+}
+
+// compileNode 把一棵表达式子树按后序遍历展开为字节码，追加到 instructions 之后。
+// 遇到无法编译的节点类型时返回 error 而不是 panic：字节码 VM 没有 Parser.eval
+// 那样按节点记忆化的 Promise 机制，所以 DELAY_NODE（以及任何包着它的
+// FUNCTION_NODE，比如 FORCE(DELAY(...))）在这里被明确拒绝，而不是生成错误的
+// 指令流或让整个进程崩溃；这类脚本应改用 Parser.ParseApp 做树遍历求值。
+func compileNode(instructions []Instruction, node *Node) ([]Instruction, error) {
+	switch node.Type {
+	case NUMBER_NODE:
+		return append(instructions, Instruction{Op: OP_PUSH_CONST, Operand: node.Value}), nil
+	case VARIABLE_NODE:
+		return append(instructions, Instruction{Op: OP_PUSH_VAR, Operand: node.Value}), nil
+	case SYMBOL_NODE:
+		return append(instructions, Instruction{Op: OP_PUSH_SYMBOL, Operand: node.Value}), nil
+	case NOT_NODE:
+		instructions, err := compileNode(instructions, node.Children[0])
+		if err != nil {
+			return nil, err
+		}
+		return append(instructions, Instruction{Op: OP_NOT}), nil
+	case EXPRESSION_NODE:
+		var err error
+		instructions, err = compileNode(instructions, node.Children[0])
+		if err != nil {
+			return nil, err
+		}
+		instructions, err = compileNode(instructions, node.Children[1])
+		if err != nil {
+			return nil, err
+		}
+		op := node.Children[2].Value
+		switch op {
+		case "+", "-", "*", "/":
+			return append(instructions, Instruction{Op: OP_BINOP, Operand: op}), nil
+		default:
+			return append(instructions, Instruction{Op: OP_CMP, Operand: op}), nil
+		}
+	case FUNCTION_NODE:
+		var err error
+		for _, arg := range node.Children {
+			instructions, err = compileNode(instructions, arg)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return append(instructions, Instruction{Op: OP_CALL, Operand: node.Value, Arg: len(node.Children)}), nil
+	case DELAY_NODE:
+		return nil, fmt.Errorf("DELAY/FORCE 暂不支持编译为字节码程序，请改用 Parser.ParseApp 进行树遍历求值")
+	default:
+		return nil, fmt.Errorf("cannot compile node type: %s", node.Type)
+	}
+}
+
+// Run 在给定的行情数据上执行编译好的程序，返回每个赋值符号对应的时间序列。
+func (prog *Program) Run(data map[string][]float64) (SymbolTable, error) {
+	symbolTable := make(SymbolTable)
+	dataLen := 0
+	for _, v := range data {
+		dataLen = len(v)
+		break
+	}
+
+	var stack [][]float64
+	pop := func() []float64 {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return top
+	}
+
+	for _, ins := range prog.instructions {
+		switch ins.Op {
+		case OP_PUSH_CONST:
+			num, err := strconv.ParseFloat(ins.Operand, 64)
+			if err != nil {
+				return nil, err
+			}
+			series := make([]float64, dataLen)
+			for i := range series {
+				series[i] = num
+			}
+			stack = append(stack, series)
+		case OP_PUSH_VAR:
+			val, ok := data[ins.Operand]
+			if !ok {
+				return nil, fmt.Errorf("undefined variable: %s", ins.Operand)
+			}
+			stack = append(stack, val)
+		case OP_PUSH_SYMBOL:
+			val, ok := symbolTable[ins.Operand]
+			if !ok {
+				return nil, fmt.Errorf("undefined symbol: %s", ins.Operand)
+			}
+			stack = append(stack, val)
+		case OP_NOT:
+			operand := pop()
+			res := make([]float64, len(operand))
+			for i, v := range operand {
+				if math.IsNaN(v) {
+					res[i] = math.NaN()
+				} else if v == 0 {
+					res[i] = 1.0
+				} else {
+					res[i] = 0.0
+				}
+			}
+			stack = append(stack, res)
+		case OP_BINOP:
+			right := pop()
+			left := pop()
+			res, err := vmApplyArith(ins.Operand, left, right)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, res)
+		case OP_CMP:
+			right := pop()
+			left := pop()
+			stack = append(stack, vmApplyCmp(ins.Operand, left, right))
+		case OP_CALL:
+			args := make([][]float64, ins.Arg)
+			for i := ins.Arg - 1; i >= 0; i-- {
+				args[i] = pop()
+			}
+			res, err := vmCall(prog.registry, ins.Operand, args)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, res)
+		case OP_STORE:
+			symbolTable[ins.Operand] = pop()
+		default:
+			return nil, fmt.Errorf("unknown opcode: %s", ins.Op)
+		}
+	}
+	return symbolTable, nil
+}
+
+func vmApplyArith(op string, left, right []float64) ([]float64, error) {
+	if len(left) != len(right) {
+		return nil, fmt.Errorf("时间序列长度不匹配")
+	}
+	res := make([]float64, len(left))
+	for i := range left {
+		switch op {
+		case "+":
+			res[i] = left[i] + right[i]
+		case "-":
+			res[i] = left[i] - right[i]
+		case "*":
+			res[i] = left[i] * right[i]
+		case "/":
+			if right[i] == 0 {
+				return nil, fmt.Errorf("除数为零")
+			}
+			res[i] = left[i] / right[i]
+		default:
+			return nil, fmt.Errorf("不支持的运算符: %s", op)
+		}
+	}
+	return res, nil
+}
+
+func vmApplyCmp(op string, left, right []float64) []float64 {
+	res := make([]float64, len(left))
+	for i := range left {
+		switch op {
+		case "AND", "OR":
+			res[i] = applyLogic(op, left[i], right[i])
+		default:
+			res[i] = applyComparison(op, left[i], right[i])
+		}
+	}
+	return res
+}
+
+// vmCall 派发一条已编译的 CALL 指令。它不再维护一份重复的内置函数 switch，
+// 而是直接复用 ParseApp 所用的同一个 FunctionRegistry，这样注册到 registry
+// 里的自定义指标通过 Compile/Run 也能直接调用。period/offset 这类参数在编译
+// 期被当作常量表达式展开成了整条序列，syntheticRawArgs 把它们的首个元素还
+// 原成带 Value 字段的占位 Node，使 REF/MA 这类读取 rawArgs[i].Value 的
+// IndicatorFunc 不用改造就能在 VM 里工作。
+func vmCall(registry *FunctionRegistry, name string, args [][]float64) ([]float64, error) {
+	return registry.Call(name, args, syntheticRawArgs(args))
+}
+
+func syntheticRawArgs(args [][]float64) []*Node {
+	raw := make([]*Node, len(args))
+	for i, series := range args {
+		v := 0.0
+		if len(series) > 0 {
+			v = series[0]
+		}
+		raw[i] = &Node{Value: strconv.FormatFloat(v, 'f', -1, 64)}
+	}
+	return raw
+}
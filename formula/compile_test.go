@@ -0,0 +1,249 @@
+package formula
+
+import (
+	"math"
+	"testing"
+)
+
+func closeSeries() map[string][]float64 {
+	return map[string][]float64{
+		"CLOSE": {10, 12, 15, 14, 16, 18, 20, 19, 22, 25},
+	}
+}
+
+func runBoth(t *testing.T, src string, data map[string][]float64) (treeWalk, vm []float64) {
+	t.Helper()
+	tokens, err := NewLexer(src).Tokenize()
+	if err != nil {
+		t.Fatalf("Tokenize(%q): %v", src, err)
+	}
+	parser := NewParser(tokens, data, nil, src)
+	if err := parser.ParseApp(); err != nil {
+		t.Fatalf("ParseApp(%q): %v", src, err)
+	}
+	prog, err := Compile(src, nil)
+	if err != nil {
+		t.Fatalf("Compile(%q): %v", src, err)
+	}
+	result, err := prog.Run(data)
+	if err != nil {
+		t.Fatalf("Run(%q): %v", src, err)
+	}
+	return parser.Result()["V1"], result["V1"]
+}
+
+func assertSeriesEqual(t *testing.T, treeWalk, vm []float64) {
+	t.Helper()
+	if len(treeWalk) != len(vm) {
+		t.Fatalf("length mismatch: tree-walk=%d vm=%d", len(treeWalk), len(vm))
+	}
+	for i := range treeWalk {
+		a, b := treeWalk[i], vm[i]
+		if math.IsNaN(a) && math.IsNaN(b) {
+			continue
+		}
+		if a != b {
+			t.Fatalf("bar %d: tree-walk=%v vm=%v", i, a, b)
+		}
+	}
+}
+
+// TestCompileRunLogicAndComparison 验证 chunk0-1 引入的逻辑/比较运算符在
+// Compile/Run（字节码 VM）和 ParseApp（树遍历）下结果一致。
+func TestCompileRunLogicAndComparison(t *testing.T) {
+	src := "V1:=(CLOSE>15) AND (CLOSE<22);"
+	treeWalk, vm := runBoth(t, src, closeSeries())
+	assertSeriesEqual(t, treeWalk, vm)
+}
+
+// TestCompileRunIfCross 验证 chunk0-1 引入的 IF/CROSS 在两种求值路径下一致。
+func TestCompileRunIfCross(t *testing.T) {
+	src := "V1:=IF(CROSS(CLOSE, MA(CLOSE,3)), 1, 0);"
+	treeWalk, vm := runBoth(t, src, closeSeries())
+	assertSeriesEqual(t, treeWalk, vm)
+}
+
+// TestCompileRejectsDelay 验证编译一个包含 DELAY/FORCE 的脚本会返回错误而不是
+// panic：字节码 VM 没有树遍历求值器那样按节点记忆化的 Promise 机制。
+func TestCompileRejectsDelay(t *testing.T) {
+	for _, src := range []string{
+		"V1:=DELAY(HHV(CLOSE,5));",
+		"V1:=FORCE(DELAY(CLOSE));",
+		"V1:=IF(CLOSE>15, DELAY(HHV(CLOSE,5)), DELAY(LLV(CLOSE,5)));",
+	} {
+		if _, err := Compile(src, nil); err == nil {
+			t.Errorf("Compile(%q): expected error, got nil", src)
+		}
+	}
+}
+
+// TestCompileWithCustomRegistry 验证 chunk0-3 引入的自定义 FunctionRegistry
+// 注册的指标可以通过 Compile/Run 调用，而不仅仅是 ParseApp。
+func TestCompileWithCustomRegistry(t *testing.T) {
+	reg := NewFunctionRegistry()
+	reg.RegisterConstant("CLOSE")
+	reg.Register("DOUBLE", 1, func(args [][]float64, rawArgs []*Node) ([]float64, error) {
+		res := make([]float64, len(args[0]))
+		for i, v := range args[0] {
+			res[i] = v * 2
+		}
+		return res, nil
+	})
+
+	src := "V1:=DOUBLE(CLOSE);"
+	prog, err := Compile(src, reg)
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	data := map[string][]float64{"CLOSE": {1, 2, 3}}
+	result, err := prog.Run(data)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := []float64{2, 4, 6}
+	assertSeriesEqual(t, want, result["V1"])
+}
+
+// TestCompileCachesPerRegistry 验证 Compile(src, nil) 对同一份源码重复编译时
+// 命中缓存，nil（默认 registry）也不例外。
+func TestCompileCachesPerRegistry(t *testing.T) {
+	src := "V1:=CLOSE+1;"
+	p1, err := Compile(src, nil)
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	p2, err := Compile(src, nil)
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	if p1 != p2 {
+		t.Fatalf("expected Compile(src, nil) to be cached across calls")
+	}
+}
+
+// TestCompileRunMovingAverages 验证 chunk0-3 引入的 SMA/WMA/EMA 在 Compile/Run
+// 和 ParseApp 两种求值路径下结果一致。
+func TestCompileRunMovingAverages(t *testing.T) {
+	for _, src := range []string{
+		"V1:=SMA(CLOSE,5,1);",
+		"V1:=WMA(CLOSE,5);",
+		"V1:=EMA(CLOSE,5);",
+	} {
+		treeWalk, vm := runBoth(t, src, closeSeries())
+		assertSeriesEqual(t, treeWalk, vm)
+	}
+}
+
+// TestCompileRunNot 验证 NOT/! 在两种求值路径下结果一致。
+func TestCompileRunNot(t *testing.T) {
+	for _, src := range []string{
+		"V1:=NOT (CLOSE>15);",
+		"V1:=!(CLOSE>15);",
+	} {
+		treeWalk, vm := runBoth(t, src, closeSeries())
+		assertSeriesEqual(t, treeWalk, vm)
+	}
+}
+
+// TestCompileCustomRegistryOverridesBuiltin 验证自定义 FunctionRegistry 可以
+// 覆盖内置函数名（这里是 MA），并且 ParseApp 和 Compile/Run 都使用覆盖后的实现。
+func TestCompileCustomRegistryOverridesBuiltin(t *testing.T) {
+	reg := NewFunctionRegistry()
+	reg.RegisterConstant("CLOSE")
+	reg.Register("MA", 2, func(args [][]float64, rawArgs []*Node) ([]float64, error) {
+		res := make([]float64, len(args[0]))
+		for i, v := range args[0] {
+			res[i] = v
+		}
+		return res, nil
+	})
+
+	src := "V1:=MA(CLOSE,5);"
+	data := map[string][]float64{"CLOSE": {1, 2, 3}}
+
+	tokens, err := NewLexer(src).Tokenize()
+	if err != nil {
+		t.Fatalf("Tokenize: %v", err)
+	}
+	parser := NewParser(tokens, data, reg, src)
+	if err := parser.ParseApp(); err != nil {
+		t.Fatalf("ParseApp: %v", err)
+	}
+	assertSeriesEqual(t, data["CLOSE"], parser.Result()["V1"])
+
+	prog, err := Compile(src, reg)
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	result, err := prog.Run(data)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	assertSeriesEqual(t, data["CLOSE"], result["V1"])
+}
+
+// TestParseErrorPositionPrecision 验证 parseFunctionCall/parseDelay 报告的错误
+// 位置指向真正出错的 token，而不是退回到语句起始位置（chunk0-5 review 修复的
+// 回归用例）。
+func TestParseErrorPositionPrecision(t *testing.T) {
+	src := "V1:=1+2;\nV2:=MA(CLOSE,\n5;\nV3:=CLOSE+1;"
+	tokens, err := NewLexer(src).Tokenize()
+	if err != nil {
+		t.Fatalf("Tokenize: %v", err)
+	}
+	parser := NewParser(tokens, closeSeries(), nil, src)
+	err = parser.ParseApp()
+	if err == nil {
+		t.Fatal("expected ParseApp to return an error")
+	}
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("expected ErrorList, got %T", err)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 recovered error, got %d: %v", len(errs), errs)
+	}
+	if errs[0].Pos.Line != 3 {
+		t.Errorf("expected error on line 3 (the actual offending token), got line %d", errs[0].Pos.Line)
+	}
+}
+
+// TestParseAppMultiErrorRecovery 验证 chunk0-5 的多错误恢复：一个脚本里两条
+// 独立出错的语句应该都被收集进 ErrorList，而不是在第一个错误处整体失败，
+// 其余能正常求值的语句也应该保留结果。
+func TestParseAppMultiErrorRecovery(t *testing.T) {
+	src := `
+	V1:=(1+CLOSE)*2;
+	V2:=1/0;
+	V3:=UNDEFINEDSYM;
+	V4:=MA(V1, 5);
+	`
+	tokens, err := NewLexer(src).Tokenize()
+	if err != nil {
+		t.Fatalf("Tokenize: %v", err)
+	}
+	parser := NewParser(tokens, closeSeries(), nil, src)
+	err = parser.ParseApp()
+	if err == nil {
+		t.Fatal("expected ParseApp to return an error")
+	}
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("expected ErrorList, got %T", err)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 recovered errors, got %d: %v", len(errs), errs)
+	}
+	if errs[0].Pos.Line != 3 {
+		t.Errorf("expected first error on line 3, got line %d", errs[0].Pos.Line)
+	}
+	if errs[1].Pos.Line != 4 {
+		t.Errorf("expected second error on line 4, got line %d", errs[1].Pos.Line)
+	}
+	if _, ok := parser.Result()["V1"]; !ok {
+		t.Error("expected V1 to still be evaluated despite later errors")
+	}
+	if _, ok := parser.Result()["V4"]; !ok {
+		t.Error("expected V4 to still be evaluated despite earlier errors")
+	}
+}
@@ -0,0 +1,59 @@
+package formula
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FormulaError is a single diagnostic anchored to a source position, used in
+// place of bare panics/fmt.Errorf wherever the parser or evaluator has a
+// Position on hand (from a Token or a Node). Snippet is the single source
+// line Pos falls on, so callers (and error messages) don't need to re-slice
+// the original script themselves.
+type FormulaError struct {
+	Pos     Position
+	Msg     string
+	Snippet string
+}
+
+func (e *FormulaError) Error() string {
+	if e.Snippet == "" {
+		return fmt.Sprintf("%d:%d: %s", e.Pos.Line, e.Pos.Column, e.Msg)
+	}
+	return fmt.Sprintf("%d:%d: %s\n\t%s", e.Pos.Line, e.Pos.Column, e.Msg, e.Snippet)
+}
+
+// ErrorList collects every FormulaError ParseApp recovers from in a single
+// pass, so a script with several broken statements gets reported all at
+// once instead of failing on the first one.
+type ErrorList []*FormulaError
+
+func (el ErrorList) Error() string {
+	if len(el) == 1 {
+		return el[0].Error()
+	}
+	msgs := make([]string, len(el))
+	for i, e := range el {
+		msgs[i] = e.Error()
+	}
+	return fmt.Sprintf("%d errors:\n%s", len(el), strings.Join(msgs, "\n"))
+}
+
+// snippetAt returns the single line of src that pos falls on (trimmed of its
+// trailing \r\n), or "" if src is unavailable or pos is out of range. Lexer
+// and Parser keep the original source text around just so FormulaErrors can
+// fill in Snippet without the caller re-deriving it from Line/Column.
+func snippetAt(src string, pos Position) string {
+	if src == "" {
+		return ""
+	}
+	lineStart := pos.Offset - (pos.Column - 1)
+	if lineStart < 0 || lineStart > len(src) {
+		return ""
+	}
+	lineEnd := lineStart
+	for lineEnd < len(src) && src[lineEnd] != '\n' {
+		lineEnd++
+	}
+	return strings.TrimRight(src[lineStart:lineEnd], "\r")
+}
@@ -0,0 +1,154 @@
+package formula
+
+import "math"
+
+// 本文件存放纯粹基于 []float64 序列运算的指标实现，不依赖 AST 节点。
+// Parser.eval 的树遍历求值器和 VM 的字节码求值器都调用这些函数，
+// 避免同一套指标逻辑维护两份。
+
+func maSeries(series []float64, period int) []float64 {
+	res := make([]float64, len(series))
+	for i := range res {
+		sum := 0.0
+		count := 0
+		for j := i - period + 1; j <= i; j++ {
+			if j >= 0 && j < len(series) && !math.IsNaN(series[j]) {
+				sum += series[j]
+				count++
+			}
+		}
+		if count > 0 {
+			res[i] = sum / float64(count)
+		} else {
+			res[i] = math.NaN()
+		}
+	}
+	return res
+}
+
+func refSeries(series []float64, offset int) []float64 {
+	res := make([]float64, len(series))
+	for i := range res {
+		if i >= offset && i-offset < len(series) && i-offset >= 0 {
+			res[i] = series[i-offset]
+		} else {
+			res[i] = math.NaN()
+		}
+	}
+	return res
+}
+
+func hhvSeries(series []float64, period int) []float64 {
+	res := make([]float64, len(series))
+	for i := range res {
+		max := math.NaN()
+		for j := i - period + 1; j <= i; j++ {
+			if j >= 0 && j < len(series) && (!math.IsNaN(series[j]) && (math.IsNaN(max) || series[j] > max)) {
+				max = series[j]
+			}
+		}
+		res[i] = max
+	}
+	return res
+}
+
+func llvSeries(series []float64, period int) []float64 {
+	res := make([]float64, len(series))
+	for i := range res {
+		min := math.NaN()
+		for j := i - period + 1; j <= i; j++ {
+			if j >= 0 && j < len(series) && (!math.IsNaN(series[j]) && (math.IsNaN(min) || series[j] < min)) {
+				min = series[j]
+			}
+		}
+		res[i] = min
+	}
+	return res
+}
+
+// smaSeries implements the TDX-style SMA(x, n, m): sma[i] = (m*x[i] +
+// (n-m)*sma[i-1]) / n, seeded with sma[0] = x[0].
+func smaSeries(x []float64, n int, m float64) []float64 {
+	res := make([]float64, len(x))
+	for i := range res {
+		if i == 0 {
+			res[i] = x[i]
+			continue
+		}
+		res[i] = (m*x[i] + (float64(n)-m)*res[i-1]) / float64(n)
+	}
+	return res
+}
+
+// wmaSeries implements a linearly weighted moving average: the current bar
+// gets weight n, the bar n-1 back gets weight 1, normalized by n(n+1)/2.
+// NaN until the window has n bars of history.
+func wmaSeries(x []float64, n int) []float64 {
+	weightSum := float64(n*(n+1)) / 2
+	res := make([]float64, len(x))
+	for i := range res {
+		if i < n-1 {
+			res[i] = math.NaN()
+			continue
+		}
+		sum := 0.0
+		for k := 0; k < n; k++ {
+			sum += float64(n-k) * x[i-k]
+		}
+		res[i] = sum / weightSum
+	}
+	return res
+}
+
+// emaSeries implements the standard exponential moving average with
+// alpha = 2/(n+1), seeded with ema[0] = x[0].
+func emaSeries(x []float64, n int) []float64 {
+	alpha := 2.0 / (float64(n) + 1)
+	res := make([]float64, len(x))
+	for i := range res {
+		if i == 0 {
+			res[i] = x[i]
+			continue
+		}
+		res[i] = alpha*x[i] + (1-alpha)*res[i-1]
+	}
+	return res
+}
+
+func ifSeries(cond, a, b []float64) []float64 {
+	res := make([]float64, len(cond))
+	for i := range res {
+		switch {
+		case math.IsNaN(cond[i]):
+			res[i] = math.NaN()
+		case cond[i] != 0:
+			res[i] = a[i]
+		default:
+			res[i] = b[i]
+		}
+	}
+	return res
+}
+
+// crossSeries implements CROSS(a, b), equivalent to REF(a,1)<=REF(b,1) &&
+// a>b. Bar 0 has no prior bar, so REF(a,1)/REF(b,1) are NaN there and the
+// equivalent expression evaluates to NaN; crossSeries matches that and
+// returns NaN at bar 0 rather than 0.
+func crossSeries(a, b []float64) []float64 {
+	res := make([]float64, len(a))
+	for i := range res {
+		if i == 0 {
+			res[i] = math.NaN()
+			continue
+		}
+		prevA, prevB, curA, curB := a[i-1], b[i-1], a[i], b[i]
+		if math.IsNaN(prevA) || math.IsNaN(prevB) || math.IsNaN(curA) || math.IsNaN(curB) {
+			res[i] = math.NaN()
+		} else if prevA <= prevB && curA > curB {
+			res[i] = 1.0
+		} else {
+			res[i] = 0.0
+		}
+	}
+	return res
+}
@@ -12,6 +12,7 @@ const (
 	NUMBER        TokenType = "NUMBER"
 	OPERATOR      TokenType = "OPERATOR"
 	COMPARISON_OP TokenType = "COMPARISON_OP"
+	LOGIC_OP      TokenType = "LOGIC_OP" // 新增 LOGIC_OP，覆盖 AND/OR/NOT 及 &&/||/!
 	SEMICOLON     TokenType = "SEMICOLON"
 	ASSIGN_OP     TokenType = "ASSIGN_OP"
 	IDENTIFIER    TokenType = "IDENTIFIER"
@@ -21,20 +22,45 @@ const (
 	RPAREN        TokenType = "RPAREN" // 新增 RPAREN
 )
 
+// logicKeywords 把布尔关键字映射成它们对应的符号写法，lexer 在识别标识符时
+// 会将这些关键字直接识别为 LOGIC_OP token，而不是 IDENTIFIER。
+var logicKeywords = map[string]string{
+	"AND": "&&",
+	"OR":  "||",
+	"NOT": "!",
+}
+
+// Position 标识源码中的一个位置，Line/Column 从 1 开始，Offset 是从 0 开始的
+// 字节偏移，供错误信息定位和截取 Snippet 使用。
+type Position struct {
+	Line   int
+	Column int
+	Offset int
+}
+
 // Token structure
 type Token struct {
-	Type  TokenType
-	Value string
+	Type   TokenType
+	Value  string
+	Line   int
+	Column int
+	Offset int
+}
+
+func (t Token) Pos() Position {
+	return Position{Line: t.Line, Column: t.Column, Offset: t.Offset}
 }
 
 // Lexer structure
 type Lexer struct {
 	input  string
 	cursor int
+	line   int
+	column int
 }
 
 func NewLexer(input string) *Lexer {
-	return &Lexer{input: input}
+	return &Lexer{input: input, line: 1, column: 1}
 }
 
 // Consume a character from the input; return EOF token type when end of input is reached.
@@ -44,6 +70,12 @@ func (l *Lexer) consume() (rune, TokenType) {
 	}
 	char := rune(l.input[l.cursor])
 	l.cursor++
+	if char == '\n' {
+		l.line++
+		l.column = 1
+	} else {
+		l.column++
+	}
 	return char, "" // "" means no special token type
 }
 
@@ -59,6 +91,7 @@ func (l *Lexer) peek() (rune, TokenType) {
 func (l *Lexer) Tokenize() ([]Token, error) {
 	tokens := []Token{}
 	for {
+		startOffset, startLine, startCol := l.cursor, l.line, l.column
 		char, tokenType := l.consume()
 		if tokenType == EOF {
 			break // End of input
@@ -68,6 +101,16 @@ func (l *Lexer) Tokenize() ([]Token, error) {
 			continue // Skip whitespace
 		}
 
+		// newToken 用本次迭代开始时的位置（即当前 token 的起始位置）构造 Token。
+		newToken := func(t TokenType, value string) Token {
+			return Token{Type: t, Value: value, Line: startLine, Column: startCol, Offset: startOffset}
+		}
+
+		pos := Position{Line: startLine, Column: startCol, Offset: startOffset}
+		invalidChar := func(c rune) error {
+			return &FormulaError{Pos: pos, Msg: fmt.Sprintf("invalid character: %c", c), Snippet: snippetAt(l.input, pos)}
+		}
+
 		switch {
 		case unicode.IsDigit(char) || char == '.':
 			// Handle numbers
@@ -80,7 +123,7 @@ func (l *Lexer) Tokenize() ([]Token, error) {
 				}
 				char, _ = l.consume() // Consume the digit or '.'
 			}
-			tokens = append(tokens, Token{Type: NUMBER, Value: numStr})
+			tokens = append(tokens, newToken(NUMBER, numStr))
 
 		case unicode.IsLetter(char):
 			// Handle identifiers
@@ -93,35 +136,62 @@ func (l *Lexer) Tokenize() ([]Token, error) {
 				}
 				char, _ = l.consume() // Consume the character
 			}
-			tokens = append(tokens, Token{Type: IDENTIFIER, Value: identStr})
+			if sym, ok := logicKeywords[identStr]; ok {
+				tokens = append(tokens, newToken(LOGIC_OP, sym))
+			} else {
+				tokens = append(tokens, newToken(IDENTIFIER, identStr))
+			}
 
 		case string(char) == "+" || string(char) == "-" || string(char) == "*" || string(char) == "/" || char == ',':
 			// Handle operators and parentheses
-			tokens = append(tokens, Token{Type: OPERATOR, Value: string(char)})
+			tokens = append(tokens, newToken(OPERATOR, string(char)))
 		case string(char) == "(":
-			tokens = append(tokens, Token{Type: LPAREN, Value: "("})
+			tokens = append(tokens, newToken(LPAREN, "("))
 		case string(char) == ")":
-			tokens = append(tokens, Token{Type: RPAREN, Value: ")"})
+			tokens = append(tokens, newToken(RPAREN, ")"))
 		case string(char) == ":":
 			nextChar, _ := l.peek()
 			if nextChar == '=' {
-				tokens = append(tokens, Token{Type: ASSIGN_OP, Value: ":="})
 				l.consume()
+				tokens = append(tokens, newToken(ASSIGN_OP, ":="))
 			} else {
-				tokens = append(tokens, Token{Type: ASSIGN_OP, Value: ":"})
+				tokens = append(tokens, newToken(ASSIGN_OP, ":"))
 			}
-		case string(char) == "<" || string(char) == ">" || string(char) == "=" || string(char) == "!":
+		case string(char) == "<" || string(char) == ">" || string(char) == "=":
 			opStr := string(char)
 			nextChar, _ := l.peek()
-			if nextChar == '=' && (char == '<' || char == '>' || char == '=' || char == '!') {
+			if nextChar == '=' {
 				opStr += string(nextChar)
 				l.consume()
 			}
-			tokens = append(tokens, Token{Type: COMPARISON_OP, Value: opStr})
+			tokens = append(tokens, newToken(COMPARISON_OP, opStr))
+		case char == '!':
+			// "!=" 是比较运算符，单独的 "!" 是逻辑非
+			nextChar, _ := l.peek()
+			if nextChar == '=' {
+				l.consume()
+				tokens = append(tokens, newToken(COMPARISON_OP, "!="))
+			} else {
+				tokens = append(tokens, newToken(LOGIC_OP, "!"))
+			}
+		case char == '&':
+			nextChar, _ := l.peek()
+			if nextChar != '&' {
+				return nil, invalidChar(char)
+			}
+			l.consume()
+			tokens = append(tokens, newToken(LOGIC_OP, "&&"))
+		case char == '|':
+			nextChar, _ := l.peek()
+			if nextChar != '|' {
+				return nil, invalidChar(char)
+			}
+			l.consume()
+			tokens = append(tokens, newToken(LOGIC_OP, "||"))
 		case string(char) == ";": // 添加对分号的处理
-			tokens = append(tokens, Token{Type: SEMICOLON, Value: ";"})
+			tokens = append(tokens, newToken(SEMICOLON, ";"))
 		default:
-			return nil, fmt.Errorf("invalid character: %c", char)
+			return nil, invalidChar(char)
 		}
 	}
 	return tokens, nil
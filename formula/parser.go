@@ -34,6 +34,34 @@ reserved_func  = "MA" | "REF" | "HHV" | "LLV" | "SMA" | "WMA" | "EMA"; // 保留
 
 ```
 
+```ebnf
+// 布尔/逻辑运算引入了新的优先级层次，从低到高依次是:
+// logic_or < logic_and < logic_not < comparison < expression(加减) < term(乘除)
+statement      = assignment | logic_or;
+logic_or       = logic_and, { ("OR" | "||"), logic_and };
+logic_and      = logic_not, { ("AND" | "&&"), logic_not };
+logic_not      = [ ("NOT" | "!") ], comparison;
+comparison     = expression, [ comp_op, expression ];
+comp_op        = "<" | "<=" | ">" | ">=" | "=" | "==" | "!=";
+reserved_func  = reserved_func | "IF" | "CROSS"; // IF(cond,a,b)、CROSS(a,b)
+```
+
+```ebnf
+// DELAY(expr) 是一个特殊的 factor：它捕获子表达式而不是立即求值，返回的
+// DELAY_NODE 要等 FORCE(promise) 或被 IF 选中的分支时才会求值一次并记住结果。
+factor = number | variable | function_call | delay | "(", expression, ")";
+delay  = "DELAY", "(", expression, ")";
+```
+
+保留变量和保留函数不再是写死在 Parser 里的表：它们由传给 NewParser 的
+FunctionRegistry 决定，SMA/WMA/EMA 这样的内置指标也是通过
+DefaultRegistry() 注册的普通函数，调用方可以注册自己的指标而无需修改本包。
+
+每个 Token 和 Node 都带有源码中的 Position（行/列/偏移），解析或求值出错
+时会产生 *FormulaError 而不是裸的字符串错误或 panic。ParseApp 在某条语句
+解析失败后会跳到下一个 ';' 继续解析剩余语句，把所有错误收集进一个
+ErrorList 一次性返回，而不是碰到第一个错误就整体失败。
+
 在这个 EBNF 中：
 
 * `program` 是一个语句序列。
@@ -57,6 +85,8 @@ const (
 	VARIABLE_NODE   NodeType = "VARIABLE" // 新增变量节点类型
 	SYMBOL_NODE     NodeType = "SYMBOL"   // 新增符号节点类型
 	FUNCTION_NODE   NodeType = "FUNCTION"
+	NOT_NODE        NodeType = "NOT"   // 新增逻辑非节点类型，一元运算
+	DELAY_NODE      NodeType = "DELAY" // DELAY(expr) 捕获子表达式，求值被推迟到 FORCE
 )
 
 type Node struct {
@@ -64,59 +94,123 @@ type Node struct {
 	Value    string
 	Children []*Node
 	Result   []float64
+	Pos      Position // 节点在源码中的起始位置，用于错误定位
 }
 
 type SymbolTable map[string][]float64
 
+// Promise is what a DELAY_NODE evaluates to: a snapshot of the data/symbol
+// bindings in effect when the delay was created, plus the captured AST
+// subtree. FORCE evaluates it at most once and memoizes the result back
+// into value.
+type Promise struct {
+	node        *Node
+	data        map[string][]float64
+	symbolTable SymbolTable
+	evaluated   bool
+	value       []float64
+}
+
 // Parser structure
 type Parser struct {
-	tokens        []Token
-	cursor        int
-	data          map[string][]float64
-	symbolTable   SymbolTable
-	reservedWords map[string]bool
-}
-
-func NewParser(tokens []Token, data map[string][]float64) *Parser {
-	reservedWords := make(map[string]bool)
-	reservedWords["CLOSE"] = true
-	reservedWords["OPEN"] = true
-	reservedWords["HIGH"] = true
-	reservedWords["LOW"] = true
-	reservedWords["MA"] = true
-	reservedWords["REF"] = true
-	reservedWords["HHV"] = true
-	reservedWords["LLV"] = true
-	reservedWords["SMA"] = true
-	reservedWords["WMA"] = true
-	reservedWords["EMA"] = true
-	return &Parser{tokens: tokens, data: data, symbolTable: make(SymbolTable), reservedWords: reservedWords}
+	tokens      []Token
+	cursor      int
+	data        map[string][]float64
+	symbolTable SymbolTable
+	registry    *FunctionRegistry
+	promises    map[*Node]*Promise // DELAY_NODE -> 已创建的 promise，按节点做记忆化
+	source      string             // 原始源码，供 FormulaError 截取 Snippet 使用
+}
+
+// NewParser builds a Parser over tokens/data. A nil registry falls back to
+// DefaultRegistry, which carries the built-in reserved variables and
+// indicator functions; pass a custom FunctionRegistry to add or override
+// indicators without editing this package. source is the original script
+// text tokens was lexed from; it's kept around only so FormulaErrors raised
+// during parsing/evaluation can fill in their Snippet.
+func NewParser(tokens []Token, data map[string][]float64, registry *FunctionRegistry, source string) *Parser {
+	if registry == nil {
+		registry = DefaultRegistry()
+	}
+	return &Parser{tokens: tokens, data: data, symbolTable: make(SymbolTable), registry: registry, promises: make(map[*Node]*Promise), source: source}
+}
+
+// newFormulaError builds a FormulaError anchored at pos, filling in Snippet
+// from the parser's source text.
+func (p *Parser) newFormulaError(pos Position, msg string) *FormulaError {
+	return &FormulaError{Pos: pos, Msg: msg, Snippet: snippetAt(p.source, pos)}
+}
+
+// toFormulaError wraps err into a FormulaError anchored at pos (filling in
+// Snippet from the parser's source), unless err is already a *FormulaError
+// with its own (more precise) position, in which case it's returned as-is
+// once its Snippet is backfilled if missing.
+func (p *Parser) toFormulaError(pos Position, err error) *FormulaError {
+	if fe, ok := err.(*FormulaError); ok {
+		if fe.Snippet == "" {
+			fe.Snippet = snippetAt(p.source, fe.Pos)
+		}
+		return fe
+	}
+	return p.newFormulaError(pos, err.Error())
 }
 
 func (p *Parser) Result() SymbolTable {
 	return p.symbolTable
 }
 
+// ParseApp parses and evaluates every statement in the script. Rather than
+// aborting on the first bad statement, it recovers at the next ';' and keeps
+// going, so a script with several broken statements is reported as one
+// ErrorList instead of forcing the caller to fix-and-rerun one error at a
+// time.
 func (p *Parser) ParseApp() error {
+	var errs ErrorList
 	for {
 		token, err := p.nextToken()
 		if err != nil {
 			if err.Error() == "no more tokens" {
-				return nil
+				break
 			}
 			return err
 		}
 		p.cursor--
-		err = p.parseStatement()
+		startPos := token.Pos()
+		if err := p.parseStatement(); err != nil {
+			errs = append(errs, p.toFormulaError(startPos, err))
+			p.recoverToNextStatement()
+			continue
+		}
+		semi, err := p.nextToken()
 		if err != nil {
-			return err
+			errs = append(errs, p.toFormulaError(startPos, err))
+			break
+		}
+		if semi.Type != SEMICOLON {
+			errs = append(errs, p.newFormulaError(semi.Pos(), "expected ';'"))
+			p.cursor--
+			p.recoverToNextStatement()
+			continue
 		}
-		token, err = p.nextToken()
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// recoverToNextStatement advances the cursor past whatever is left of a
+// broken statement until it consumes a SEMICOLON (the statement boundary)
+// or runs out of tokens, so ParseApp can keep collecting errors from the
+// rest of the script.
+func (p *Parser) recoverToNextStatement() {
+	for {
+		token, err := p.nextToken()
 		if err != nil {
-			return err
+			return
 		}
-		if token.Type != SEMICOLON {
-			return fmt.Errorf("expected ';'")
+		if token.Type == SEMICOLON {
+			return
 		}
 	}
 }
@@ -136,12 +230,12 @@ func (p *Parser) parseStatement() error {
 			return p.parseAssignment()
 		} else {
 			p.cursor -= 2 // 回退两个游标
-			_, err := p.parseExpression()
+			_, err := p.parseLogicOr()
 			return err
 		}
 	} else {
 		p.cursor-- // 回退游标
-		_, err := p.parseExpression()
+		_, err := p.parseLogicOr()
 		return err
 	}
 }
@@ -151,14 +245,17 @@ func (p *Parser) parseAssignment() error {
 	if err != nil {
 		return err
 	}
-	if _, ok := p.reservedWords[ident]; ok {
+	if p.registry.IsConstant(ident) || p.registry.IsFunction(ident) {
 		return fmt.Errorf("'%s' is a reserved word", ident)
 	}
 	assignOp, err := p.nextToken()
-	if err != nil || (assignOp.Value != ":=" && assignOp.Value != ":") {
-		return fmt.Errorf("invalid assignment operator")
+	if err != nil {
+		return err
+	}
+	if assignOp.Value != ":=" && assignOp.Value != ":" {
+		return p.newFormulaError(assignOp.Pos(), "invalid assignment operator")
 	}
-	expr, err := p.parseExpression()
+	expr, err := p.parseLogicOr()
 	if err != nil {
 		return err
 	}
@@ -176,11 +273,82 @@ func (p *Parser) parseIdentifier() (string, error) {
 		return "", err
 	}
 	if token.Type != IDENTIFIER {
-		return "", fmt.Errorf("expected identifier")
+		return "", p.newFormulaError(token.Pos(), "expected identifier")
 	}
 	return token.Value, nil
 }
 
+// parseLogicOr is the entry point for expressions; it sits above parseLogicAnd
+// in precedence (logicOr < logicAnd < logicNot < comparison < expression < term).
+func (p *Parser) parseLogicOr() (*Node, error) {
+	left, err := p.parseLogicAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, err := p.consumeLogicOp()
+		if err != nil || (op != "OR" && op != "||") {
+			p.cursor-- //回退游标
+			return left, nil
+		}
+		right, err := p.parseLogicAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &Node{Type: EXPRESSION_NODE, Pos: left.Pos, Children: []*Node{left, right, {Type: OPERATOR_NODE, Value: "OR"}}}
+	}
+}
+
+func (p *Parser) parseLogicAnd() (*Node, error) {
+	left, err := p.parseLogicNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, err := p.consumeLogicOp()
+		if err != nil || (op != "AND" && op != "&&") {
+			p.cursor-- //回退游标
+			return left, nil
+		}
+		right, err := p.parseLogicNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &Node{Type: EXPRESSION_NODE, Pos: left.Pos, Children: []*Node{left, right, {Type: OPERATOR_NODE, Value: "AND"}}}
+	}
+}
+
+// parseLogicNot 处理前缀的 NOT/!，右结合，否则直接下沉到 comparison 层。
+func (p *Parser) parseLogicNot() (*Node, error) {
+	op, err := p.consumeLogicOp()
+	if err == nil && (op == "NOT" || op == "!") {
+		operand, err := p.parseLogicNot()
+		if err != nil {
+			return nil, err
+		}
+		return &Node{Type: NOT_NODE, Pos: operand.Pos, Children: []*Node{operand}}, nil
+	}
+	p.cursor-- //回退游标
+	return p.parseComparison()
+}
+
+func (p *Parser) parseComparison() (*Node, error) {
+	left, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	token, err := p.nextToken()
+	if err != nil || token.Type != COMPARISON_OP {
+		p.cursor-- //回退游标
+		return left, nil
+	}
+	right, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	return &Node{Type: EXPRESSION_NODE, Pos: left.Pos, Children: []*Node{left, right, {Type: OPERATOR_NODE, Value: token.Value}}}, nil
+}
+
 func (p *Parser) parseExpression() (*Node, error) {
 	left, err := p.parseTerm()
 	if err != nil {
@@ -196,7 +364,7 @@ func (p *Parser) parseExpression() (*Node, error) {
 		if err != nil {
 			return nil, err
 		}
-		left = &Node{Type: EXPRESSION_NODE, Children: []*Node{left, right, {Type: OPERATOR_NODE, Value: op}}}
+		left = &Node{Type: EXPRESSION_NODE, Pos: left.Pos, Children: []*Node{left, right, {Type: OPERATOR_NODE, Value: op}}}
 	}
 }
 
@@ -215,7 +383,7 @@ func (p *Parser) parseTerm() (*Node, error) {
 		if err != nil {
 			return nil, err
 		}
-		left = &Node{Type: EXPRESSION_NODE, Children: []*Node{left, right, {Type: OPERATOR_NODE, Value: op}}}
+		left = &Node{Type: EXPRESSION_NODE, Pos: left.Pos, Children: []*Node{left, right, {Type: OPERATOR_NODE, Value: op}}}
 	}
 }
 
@@ -227,15 +395,15 @@ func (p *Parser) parseFactor() (*Node, error) {
 
 	switch token.Type {
 	case NUMBER:
-		return &Node{Type: NUMBER_NODE, Value: token.Value}, nil
+		return &Node{Type: NUMBER_NODE, Value: token.Value, Pos: token.Pos()}, nil
 	case LPAREN:
-		expr, err := p.parseExpression()
+		expr, err := p.parseLogicOr()
 		if err != nil {
 			return nil, err
 		}
 		closingParen, err := p.nextToken()
 		if err != nil || closingParen.Type != RPAREN {
-			return nil, fmt.Errorf("expected ')'")
+			return nil, p.newFormulaError(token.Pos(), "expected ')'")
 		}
 		return expr, nil
 	case IDENTIFIER:
@@ -245,31 +413,34 @@ func (p *Parser) parseFactor() (*Node, error) {
 		}
 		if next.Type == LPAREN {
 			p.cursor -= 1
-			return p.parseFunctionCall(token.Value)
+			if token.Value == "DELAY" {
+				return p.parseDelay(token.Pos())
+			}
+			return p.parseFunctionCall(token.Value, token.Pos())
 		} else {
 			p.cursor -= 1
-			if _, ok := p.reservedWords[token.Value]; ok {
-				return &Node{Type: VARIABLE_NODE, Value: token.Value}, nil
+			if p.registry.IsConstant(token.Value) || p.registry.IsFunction(token.Value) {
+				return &Node{Type: VARIABLE_NODE, Value: token.Value, Pos: token.Pos()}, nil
 			} else if val, ok := p.symbolTable[token.Value]; ok {
-				return &Node{Type: SYMBOL_NODE, Value: token.Value, Result: val}, nil
+				return &Node{Type: SYMBOL_NODE, Value: token.Value, Result: val, Pos: token.Pos()}, nil
 			} else {
-				return nil, fmt.Errorf("undefined variable or function: %s", token.Value)
+				return nil, p.newFormulaError(token.Pos(), fmt.Sprintf("undefined variable or function: %s", token.Value))
 			}
 		}
 	default:
-		return nil, fmt.Errorf("unexpected token: %s", token.Value)
+		return nil, p.newFormulaError(token.Pos(), fmt.Sprintf("unexpected token: %s", token.Value))
 	}
 }
 
-func (p *Parser) parseFunctionCall(functionName string) (*Node, error) {
-	node := &Node{Type: FUNCTION_NODE, Value: functionName, Children: []*Node{}}
+func (p *Parser) parseFunctionCall(functionName string, pos Position) (*Node, error) {
+	node := &Node{Type: FUNCTION_NODE, Value: functionName, Pos: pos, Children: []*Node{}}
 	lparen, err := p.nextToken()
 	if err != nil || lparen.Type != LPAREN {
-		return nil, fmt.Errorf("expected '('")
+		return nil, p.newFormulaError(tokenPosOr(lparen, pos), "expected '('")
 	}
 
 	for {
-		arg, err := p.parseExpression()
+		arg, err := p.parseLogicOr()
 		if err != nil {
 			return nil, err
 		}
@@ -281,12 +452,41 @@ func (p *Parser) parseFunctionCall(functionName string) (*Node, error) {
 		if next.Type == RPAREN {
 			break
 		} else if next.Value != "," {
-			return nil, fmt.Errorf("expected ',' or ')'")
+			return nil, p.newFormulaError(next.Pos(), "expected ',' or ')'")
 		}
 	}
 	return node, nil
 }
 
+// parseDelay parses DELAY(expr): unlike an ordinary function call, the inner
+// expression is kept as an unevaluated AST subtree. It is only evaluated
+// once FORCE is called on the resulting DELAY_NODE.
+func (p *Parser) parseDelay(pos Position) (*Node, error) {
+	lparen, err := p.nextToken()
+	if err != nil || lparen.Type != LPAREN {
+		return nil, p.newFormulaError(tokenPosOr(lparen, pos), "expected '('")
+	}
+	expr, err := p.parseLogicOr()
+	if err != nil {
+		return nil, err
+	}
+	rparen, err := p.nextToken()
+	if err != nil || rparen.Type != RPAREN {
+		return nil, p.newFormulaError(tokenPosOr(rparen, pos), "expected ')'")
+	}
+	return &Node{Type: DELAY_NODE, Pos: pos, Children: []*Node{expr}}, nil
+}
+
+// tokenPosOr returns tok's position, or fallback if tok is nil (nextToken
+// returns a nil token alongside its error once the token stream is
+// exhausted), so callers always have a Position to anchor a FormulaError on.
+func tokenPosOr(tok *Token, fallback Position) Position {
+	if tok != nil {
+		return tok.Pos()
+	}
+	return fallback
+}
+
 func (p *Parser) eval(node *Node) ([]float64, error) {
 	switch node.Type {
 	case NUMBER_NODE:
@@ -317,7 +517,11 @@ func (p *Parser) eval(node *Node) ([]float64, error) {
 		if err != nil {
 			return nil, err
 		}
-		return p.applyOperator(node.Children[2].Value, leftRes, rightRes), nil
+		res, err := p.applyOperator(node.Children[2].Value, leftRes, rightRes)
+		if err != nil {
+			return nil, p.toFormulaError(node.Pos, err)
+		}
+		return res, nil
 	case VARIABLE_NODE:
 		if val, ok := p.data[node.Value]; ok {
 			return val, nil
@@ -330,6 +534,22 @@ func (p *Parser) eval(node *Node) ([]float64, error) {
 		} else {
 			return nil, fmt.Errorf("undefined symbol: %s", node.Value)
 		}
+	case NOT_NODE:
+		operand, err := p.eval(node.Children[0])
+		if err != nil {
+			return nil, err
+		}
+		res := make([]float64, len(operand))
+		for i, v := range operand {
+			if math.IsNaN(v) {
+				res[i] = math.NaN()
+			} else if v == 0 {
+				res[i] = 1.0
+			} else {
+				res[i] = 0.0
+			}
+		}
+		return res, nil
 	case EXPRESSION_NODE:
 		leftRes, err := p.eval(node.Children[0])
 		if err != nil {
@@ -339,137 +559,125 @@ func (p *Parser) eval(node *Node) ([]float64, error) {
 		if err != nil {
 			return nil, err
 		}
-		return p.applyOperator(node.Children[2].Value, leftRes, rightRes), nil
+		res, err := p.applyOperator(node.Children[2].Value, leftRes, rightRes)
+		if err != nil {
+			return nil, p.toFormulaError(node.Pos, err)
+		}
+		return res, nil
+	case DELAY_NODE:
+		// DELAY 节点一般由 IF/FORCE 特判处理而不会走到这里；直接遇到时退化为
+		// 立即求值，保证语义仍然正确。
+		return p.forcePromise(node)
 	case FUNCTION_NODE:
-		switch node.Value {
-		case "MA":
-			return p.evalMA(node.Children)
-		case "REF":
-			return p.evalREF(node.Children)
-		case "HHV":
-			return p.evalHHV(node.Children)
-		case "LLV":
-			return p.evalLLV(node.Children)
-		default:
-			return nil, fmt.Errorf("undefined function: %s", node.Value)
+		if node.Value == "FORCE" {
+			return p.evalForce(node.Children)
+		}
+		if node.Value == "IF" && len(node.Children) >= 3 && (node.Children[1].Type == DELAY_NODE || node.Children[2].Type == DELAY_NODE) {
+			return p.evalIfWithPromises(node.Children)
 		}
+		args := make([][]float64, len(node.Children))
+		for i, child := range node.Children {
+			val, err := p.eval(child)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = val
+		}
+		return p.registry.Call(node.Value, args, node.Children)
 
 	default:
 		return nil, fmt.Errorf("unknown node type: %s", node.Type)
 	}
 }
 
-func (p *Parser) evalREF(args []*Node) ([]float64, error) {
-	if len(args) != 2 {
-		return nil, fmt.Errorf("REF 函数需要两个参数")
+// forcePromise evaluates a DELAY_NODE's captured subtree at most once,
+// memoizing the series back into the Promise so repeated FORCE calls (or a
+// branch selected on multiple bars) don't redo the work.
+func (p *Parser) forcePromise(delayNode *Node) ([]float64, error) {
+	promise, ok := p.promises[delayNode]
+	if !ok {
+		promise = &Promise{node: delayNode.Children[0], data: p.data, symbolTable: p.symbolTable}
+		p.promises[delayNode] = promise
 	}
-	seriesData, err := p.eval(args[0])
-	if err != nil {
-		return nil, err
+	if promise.evaluated {
+		return promise.value, nil
 	}
-	offset, err := strconv.Atoi(args[1].Value)
+	value, err := p.eval(promise.node)
 	if err != nil {
-		return nil, fmt.Errorf("REF 函数的第二个参数必须是整数")
+		return nil, err
 	}
+	promise.evaluated = true
+	promise.value = value
+	return value, nil
+}
 
-	res := make([]float64, len(seriesData))
-	for i := range res {
-		if i >= offset && i-offset < len(seriesData) && i-offset >= 0 {
-			res[i] = seriesData[i-offset]
-		} else {
-			res[i] = math.NaN()
-		}
+// evalForce implements FORCE(promise): its argument must be a DELAY(...)
+// expression, which it evaluates (if not already memoized) and returns.
+func (p *Parser) evalForce(args []*Node) ([]float64, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("FORCE 函数需要一个参数")
 	}
-	return res, nil
+	if args[0].Type != DELAY_NODE {
+		return nil, fmt.Errorf("FORCE 的参数必须是 DELAY(...) 产生的 promise")
+	}
+	return p.forcePromise(args[0])
 }
 
-func (p *Parser) evalMA(args []*Node) ([]float64, error) {
-	if len(args) != 2 {
-		return nil, fmt.Errorf("MA 函数需要两个参数")
-	}
-	seriesData, err := p.eval(args[0])
+// evalIfWithPromises implements IF(cond, a, b) when a and/or b is a
+// DELAY(...) branch: a delayed branch is only forced if at least one bar
+// actually selects it, so an expensive indicator that's never selected is
+// never computed. This is whole-branch laziness, not true per-bar
+// evaluation: a forced branch is still computed over the full series.
+func (p *Parser) evalIfWithPromises(args []*Node) ([]float64, error) {
+	cond, err := p.eval(args[0])
 	if err != nil {
 		return nil, err
 	}
-	period, err := strconv.Atoi(args[1].Value)
-	if err != nil {
-		return nil, fmt.Errorf("MA 函数的第二个参数必须是整数")
-	}
-
-	res := make([]float64, len(seriesData))
-	for i := range res {
-		sum := 0.0
-		count := 0
-		for j := i - period + 1; j <= i; j++ {
-			if j >= 0 && j < len(seriesData) && !math.IsNaN(seriesData[j]) {
-				sum += seriesData[j]
-				count++
-			}
+	anyTrue, anyFalse := false, false
+	for _, c := range cond {
+		if math.IsNaN(c) {
+			continue
 		}
-		if count > 0 {
-			res[i] = sum / float64(count)
+		if c != 0 {
+			anyTrue = true
 		} else {
+			anyFalse = true
+		}
+	}
+	nanSeries := func() []float64 {
+		res := make([]float64, len(cond))
+		for i := range res {
 			res[i] = math.NaN()
 		}
+		return res
 	}
-	return res, nil
-}
-
-func (p *Parser) evalHHV(args []*Node) ([]float64, error) {
-	if len(args) != 2 {
-		return nil, fmt.Errorf("HHV 函数需要两个参数")
+	evalBranch := func(branch *Node, selected bool) ([]float64, error) {
+		if branch.Type != DELAY_NODE {
+			return p.eval(branch)
+		}
+		if !selected {
+			return nanSeries(), nil
+		}
+		return p.forcePromise(branch)
 	}
-	seriesData, err := p.eval(args[0])
+	a, err := evalBranch(args[1], anyTrue)
 	if err != nil {
 		return nil, err
 	}
-	period, err := strconv.Atoi(args[1].Value)
-	if err != nil || period <= 0 {
-		return nil, fmt.Errorf("HHV 函数的第二个参数必须是正整数")
-	}
-
-	res := make([]float64, len(seriesData))
-	for i := range res {
-		max := math.NaN()
-		for j := i - period + 1; j <= i; j++ {
-			if j >= 0 && j < len(seriesData) && (!math.IsNaN(seriesData[j]) && (math.IsNaN(max) || seriesData[j] > max)) {
-				max = seriesData[j]
-			}
-		}
-		res[i] = max
-	}
-	return res, nil
-}
-
-func (p *Parser) evalLLV(args []*Node) ([]float64, error) {
-	if len(args) != 2 {
-		return nil, fmt.Errorf("LLV 函数需要两个参数")
-	}
-	seriesData, err := p.eval(args[0])
+	b, err := evalBranch(args[2], anyFalse)
 	if err != nil {
 		return nil, err
 	}
-	period, err := strconv.Atoi(args[1].Value)
-	if err != nil || period <= 0 {
-		return nil, fmt.Errorf("LLV 函数的第二个参数必须是正整数")
-	}
-
-	res := make([]float64, len(seriesData))
-	for i := range res {
-		min := math.NaN()
-		for j := i - period + 1; j <= i; j++ {
-			if j >= 0 && j < len(seriesData) && (!math.IsNaN(seriesData[j]) && (math.IsNaN(min) || seriesData[j] < min)) {
-				min = seriesData[j]
-			}
-		}
-		res[i] = min
-	}
-	return res, nil
+	return ifSeries(cond, a, b), nil
 }
 
-func (p *Parser) applyOperator(op string, left, right []float64) []float64 {
+// applyOperator evaluates a binary operator over two time series. It
+// returns an error instead of panicking so that mismatched series lengths,
+// division by zero and unsupported operators surface as ordinary
+// FormulaErrors at the call site, which knows the offending node's Pos.
+func (p *Parser) applyOperator(op string, left, right []float64) ([]float64, error) {
 	if len(left) != len(right) {
-		panic("时间序列长度不匹配")
+		return nil, fmt.Errorf("时间序列长度不匹配")
 	}
 	res := make([]float64, len(left))
 	for i := range left {
@@ -482,14 +690,64 @@ func (p *Parser) applyOperator(op string, left, right []float64) []float64 {
 			res[i] = left[i] * right[i]
 		case "/":
 			if right[i] == 0 {
-				panic("除数为零")
+				return nil, fmt.Errorf("除数为零")
 			}
 			res[i] = left[i] / right[i]
+		case "<", "<=", ">", ">=", "=", "==", "!=":
+			res[i] = applyComparison(op, left[i], right[i])
+		case "AND", "OR":
+			res[i] = applyLogic(op, left[i], right[i])
 		default:
-			panic(fmt.Sprintf("不支持的运算符: %s", op))
+			return nil, fmt.Errorf("不支持的运算符: %s", op)
 		}
 	}
-	return res
+	return res, nil
+}
+
+// applyComparison 对单个 bar 做比较运算，返回 0.0/1.0，NaN 按标准浮点语义传播
+// （NaN 参与的任何比较都是 false）。
+func applyComparison(op string, left, right float64) float64 {
+	if math.IsNaN(left) || math.IsNaN(right) {
+		return math.NaN()
+	}
+	var ok bool
+	switch op {
+	case "<":
+		ok = left < right
+	case "<=":
+		ok = left <= right
+	case ">":
+		ok = left > right
+	case ">=":
+		ok = left >= right
+	case "=", "==":
+		ok = left == right
+	case "!=":
+		ok = left != right
+	}
+	if ok {
+		return 1.0
+	}
+	return 0.0
+}
+
+// applyLogic 对单个 bar 做逻辑 AND/OR 运算，非零视为真，NaN 传播。
+func applyLogic(op string, left, right float64) float64 {
+	if math.IsNaN(left) || math.IsNaN(right) {
+		return math.NaN()
+	}
+	l, r := left != 0, right != 0
+	var ok bool
+	switch op {
+	case "AND":
+		ok = l && r
+	case "OR":
+		ok = l || r
+	}
+	if ok {
+		return 1.0
+	}
+	return 0.0
 }
 
 func (p *Parser) nextToken() (*Token, error) {
@@ -508,3 +766,11 @@ func (p *Parser) consumeOperator() (string, error) {
 	}
 	return token.Value, nil
 }
+
+func (p *Parser) consumeLogicOp() (string, error) {
+	token, err := p.nextToken()
+	if err != nil || token.Type != LOGIC_OP {
+		return "", err
+	}
+	return token.Value, nil
+}
@@ -0,0 +1,146 @@
+package formula
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// IndicatorFunc implements a built-in formula function. args holds every
+// argument already evaluated to a time series; rawArgs holds the matching
+// AST nodes, which functions such as REF/MA read directly to pull out
+// integer literal parameters (e.g. the period) without forcing them through
+// series evaluation.
+type IndicatorFunc func(args [][]float64, rawArgs []*Node) ([]float64, error)
+
+type registeredFunction struct {
+	arity int
+	fn    IndicatorFunc
+}
+
+// FunctionRegistry is the set of reserved variables (CLOSE, OPEN, ...) and
+// functions (MA, REF, ...) a Parser recognizes. Callers extend it with
+// Register/RegisterConstant instead of editing parser.go.
+type FunctionRegistry struct {
+	functions map[string]registeredFunction
+	constants map[string]bool
+}
+
+func NewFunctionRegistry() *FunctionRegistry {
+	return &FunctionRegistry{
+		functions: make(map[string]registeredFunction),
+		constants: make(map[string]bool),
+	}
+}
+
+// Register adds or replaces the function called name, which must be called
+// with exactly arity arguments.
+func (r *FunctionRegistry) Register(name string, arity int, fn IndicatorFunc) {
+	r.functions[name] = registeredFunction{arity: arity, fn: fn}
+}
+
+// RegisterConstant marks name (e.g. "CLOSE") as a reserved series variable.
+func (r *FunctionRegistry) RegisterConstant(name string) {
+	r.constants[name] = true
+}
+
+func (r *FunctionRegistry) IsConstant(name string) bool {
+	return r.constants[name]
+}
+
+func (r *FunctionRegistry) IsFunction(name string) bool {
+	_, ok := r.functions[name]
+	return ok
+}
+
+// Call dispatches a function call by name, checking its registered arity
+// before invoking it.
+func (r *FunctionRegistry) Call(name string, args [][]float64, rawArgs []*Node) ([]float64, error) {
+	reg, ok := r.functions[name]
+	if !ok {
+		return nil, fmt.Errorf("undefined function: %s", name)
+	}
+	if len(args) != reg.arity {
+		return nil, fmt.Errorf("%s 函数需要%d个参数", name, reg.arity)
+	}
+	return reg.fn(args, rawArgs)
+}
+
+// DefaultRegistry returns a fresh FunctionRegistry seeded with the built-in
+// reserved variables and indicator functions. NewParser uses this when no
+// registry is supplied.
+func DefaultRegistry() *FunctionRegistry {
+	r := NewFunctionRegistry()
+	r.RegisterConstant("CLOSE")
+	r.RegisterConstant("OPEN")
+	r.RegisterConstant("HIGH")
+	r.RegisterConstant("LOW")
+
+	r.Register("REF", 2, func(args [][]float64, rawArgs []*Node) ([]float64, error) {
+		offset, err := strconv.Atoi(rawArgs[1].Value)
+		if err != nil {
+			return nil, fmt.Errorf("REF 函数的第二个参数必须是整数")
+		}
+		return refSeries(args[0], offset), nil
+	})
+	r.Register("MA", 2, func(args [][]float64, rawArgs []*Node) ([]float64, error) {
+		period, err := strconv.Atoi(rawArgs[1].Value)
+		if err != nil {
+			return nil, fmt.Errorf("MA 函数的第二个参数必须是整数")
+		}
+		return maSeries(args[0], period), nil
+	})
+	r.Register("HHV", 2, func(args [][]float64, rawArgs []*Node) ([]float64, error) {
+		period, err := strconv.Atoi(rawArgs[1].Value)
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("HHV 函数的第二个参数必须是正整数")
+		}
+		return hhvSeries(args[0], period), nil
+	})
+	r.Register("LLV", 2, func(args [][]float64, rawArgs []*Node) ([]float64, error) {
+		period, err := strconv.Atoi(rawArgs[1].Value)
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("LLV 函数的第二个参数必须是正整数")
+		}
+		return llvSeries(args[0], period), nil
+	})
+	r.Register("IF", 3, func(args [][]float64, rawArgs []*Node) ([]float64, error) {
+		return ifSeries(args[0], args[1], args[2]), nil
+	})
+	r.Register("CROSS", 2, func(args [][]float64, rawArgs []*Node) ([]float64, error) {
+		return crossSeries(args[0], args[1]), nil
+	})
+	r.Register("SMA", 3, func(args [][]float64, rawArgs []*Node) ([]float64, error) {
+		n, err := strconv.Atoi(rawArgs[1].Value)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("SMA 函数的第二个参数必须是正整数")
+		}
+		m, err := strconv.ParseFloat(rawArgs[2].Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("SMA 函数的第三个参数必须是数值")
+		}
+		return smaSeries(args[0], n, m), nil
+	})
+	r.Register("WMA", 2, func(args [][]float64, rawArgs []*Node) ([]float64, error) {
+		n, err := strconv.Atoi(rawArgs[1].Value)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("WMA 函数的第二个参数必须是正整数")
+		}
+		return wmaSeries(args[0], n), nil
+	})
+	r.Register("EMA", 2, func(args [][]float64, rawArgs []*Node) ([]float64, error) {
+		n, err := strconv.Atoi(rawArgs[1].Value)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("EMA 函数的第二个参数必须是正整数")
+		}
+		return emaSeries(args[0], n), nil
+	})
+	// DELAY 和 FORCE 在 Parser.eval 里被特判处理，不会真正走到这里；
+	// 注册它们只是为了让 DELAY/FORCE 被当作保留字，不能被当成变量名赋值。
+	r.Register("DELAY", 1, func(args [][]float64, rawArgs []*Node) ([]float64, error) {
+		return nil, fmt.Errorf("DELAY 只能用于构造 promise，不能作为普通函数求值")
+	})
+	r.Register("FORCE", 1, func(args [][]float64, rawArgs []*Node) ([]float64, error) {
+		return nil, fmt.Errorf("FORCE 的参数必须是 DELAY(...) 产生的 promise")
+	})
+	return r
+}
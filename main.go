@@ -22,7 +22,7 @@ func main() {
 		fmt.Println("Error:", err)
 		return
 	}
-	parser := formula.NewParser(tokens, data)
+	parser := formula.NewParser(tokens, data, nil, expression)
 	err = parser.ParseApp()
 	if err != nil {
 		fmt.Println("Error:", err)